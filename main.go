@@ -1,19 +1,36 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log"
+	"log/slog"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/net/proxy"
 )
 
@@ -21,12 +38,60 @@ import (
 const (
 	// 目标站点（上游）
 	target = "https://translate.google.com"
+	// 上游 host，用于熔断器按 host 维度隔离状态
+	targetHost = "translate.google.com"
 	// 环境变量名
-	socks5EnvKey = "SOCKS5_URL"
+	socks5EnvKey        = "SOCKS5_URL"  // 旧的单一 SOCKS5 配置，仍然兼容
+	socks5URLsEnvKey    = "SOCKS5_URLS" // 新的多 SOCKS5 配置，逗号分隔
+	socks5StrategyEnvKey = "SOCKS5_STRATEGY"
 	// 日志目录和前缀
 	logDir          = "logs"
 	accessLogPrefix = "access"
 	errorLogPrefix  = "error"
+
+	// 熔断器相关环境变量名
+	breakerFailRatioEnvKey  = "BREAKER_FAIL_RATIO"
+	breakerMinSamplesEnvKey = "BREAKER_MIN_SAMPLES"
+	breakerCooldownEnvKey   = "BREAKER_COOLDOWN"
+
+	// 熔断器默认阈值
+	defaultBreakerFailRatio  = 0.5              // 失败率超过 50% 触发熔断
+	defaultBreakerMinSamples = 20                // 窗口内至少 20 个样本才做判定，避免低流量时误判
+	defaultBreakerCooldown   = 15 * time.Second  // Open 状态的基础冷却时间
+	breakerWindow            = 10 * time.Second  // Closed 状态下统计失败率的滚动窗口
+	breakerMaxCooldown       = 2 * time.Minute   // 冷却时间指数退避的上限
+	breakerHalfOpenProbes    = 5                  // Half-Open 状态下允许放行的探测请求数
+
+	// 响应缓存相关环境变量名
+	cacheMaxBytesEnvKey      = "CACHE_MAX_BYTES"
+	cacheEntryMaxBytesEnvKey = "CACHE_ENTRY_MAX_BYTES"
+	cacheAdminTokenEnvKey    = "CACHE_ADMIN_TOKEN"
+
+	// 响应缓存默认配置
+	defaultCacheMaxBytes      = 256 * 1024 * 1024 // 整体缓存容量上限，默认 256MB
+	defaultCacheEntryMaxBytes = 2 * 1024 * 1024    // 单条响应超过该大小就不缓存，默认 2MB
+
+	// 限流后端相关环境变量名
+	rateLimitBackendEnvKey = "RATE_LIMIT_BACKEND" // "memory"（默认）或 "redis"
+	redisURLEnvKey         = "REDIS_URL"
+
+	// 限流默认配置：每 IP 每 10 秒最多 300 次（约 30 QPS），memory/redis 两个后端共用
+	defaultRateLimitMaxRequests = 300
+	defaultRateLimitWindow      = 10 * time.Second
+
+	// Redis 限流器自身可用性的熔断阈值：样本要求低、冷却短，因为 Redis 往返通常是毫秒级
+	redisBreakerFailRatio  = 0.5
+	redisBreakerMinSamples = 5
+	redisBreakerCooldown   = 5 * time.Second
+
+	// SOCKS5 代理池健康检查配置
+	socks5FailThreshold = 3                          // 连续失败多少次标记为不健康
+	socks5ProbeInterval = 30 * time.Second            // 后台探测不健康代理的间隔
+	socks5ProbeTarget   = "translate.google.com:443" // 探测拨号的目标地址
+
+	// WebSocket 透传配置
+	wsHandshakeTimeout = 10 * time.Second // 和上游建立 TCP+TLS 并完成握手的超时
+	wsIdleTimeout      = 60 * time.Second // 双向转发时单次读写的空闲超时
 )
 
 // dailyFileWriter 按天切分日志文件的 Writer
@@ -38,9 +103,26 @@ type dailyFileWriter struct {
 	file        *os.File
 }
 
-// 访问日志 logger（单独文件）
-var accessLogger *log.Logger
-var accessLogCh chan string
+// accessEvent 是一次请求的访问日志记录，异步写到 access-YYYY-MM-DD.log，JSON 一行一条
+type accessEvent struct {
+	timestamp         time.Time
+	clientIP          string
+	method            string
+	path              string
+	upstreamStatus    int
+	bytesIn           int64
+	bytesOut          int64
+	totalLatency      time.Duration
+	dialLatency       time.Duration
+	socks5Proxy       string
+	cacheStatus       string
+	breakerState      string
+	rateLimitDecision string
+}
+
+// 访问日志（JSON 结构化，单独文件）
+var accessSlogger *slog.Logger
+var accessLogCh chan accessEvent
 
 func newDailyFileWriter(dir, prefix string) *dailyFileWriter {
 	return &dailyFileWriter{
@@ -94,15 +176,29 @@ func setupLogging() {
 	// 保留时间前缀，便于排查
 	log.SetFlags(log.LstdFlags)
 
-	// 访问日志 -> access-YYYY-MM-DD.log
+	// 访问日志 -> access-YYYY-MM-DD.log，JSON 结构化，方便后续接 ELK/Loki 之类的日志系统
 	accessWriter := newDailyFileWriter(logDir, accessLogPrefix)
-	accessLogger = log.New(accessWriter, "", log.LstdFlags)
+	accessSlogger = slog.New(slog.NewJSONHandler(accessWriter, nil))
 
 	// 异步写访问日志，避免请求被磁盘 IO 阻塞
-	accessLogCh = make(chan string, 10000)
+	accessLogCh = make(chan accessEvent, 10000)
 	go func() {
-		for msg := range accessLogCh {
-			accessLogger.Println(msg)
+		for ev := range accessLogCh {
+			accessSlogger.Info("access",
+				"ts", ev.timestamp.Format(time.RFC3339Nano),
+				"client_ip", ev.clientIP,
+				"method", ev.method,
+				"path", ev.path,
+				"upstream_status", ev.upstreamStatus,
+				"bytes_in", ev.bytesIn,
+				"bytes_out", ev.bytesOut,
+				"latency_ms", ev.totalLatency.Milliseconds(),
+				"upstream_dial_latency_ms", ev.dialLatency.Milliseconds(),
+				"socks5_proxy", ev.socks5Proxy,
+				"cache", ev.cacheStatus,
+				"breaker_state", ev.breakerState,
+				"rate_limit", ev.rateLimitDecision,
+			)
 		}
 	}()
 }
@@ -118,14 +214,60 @@ func init() {
 	} else {
 		log.Printf("[INFO] .env loaded")
 	}
+
+	// 熔断器阈值依赖 .env，必须在上面 godotenv.Load() 之后初始化
+	failRatio, minSamples, cooldown := loadBreakerConfigFromEnv()
+	defaultBreakerRegistry = newBreakerRegistry(failRatio, minSamples, cooldown)
+	log.Printf("[INFO] circuit breaker config: failRatio=%.2f minSamples=%d cooldown=%s", failRatio, minSamples, cooldown)
+
+	// 响应缓存同样依赖 .env
+	cacheMaxBytes, cacheEntryMaxBytes := loadCacheConfigFromEnv()
+	defaultResponseCache = newResponseCache(cacheMaxBytes, cacheEntryMaxBytes)
+	cacheAdminToken = strings.TrimSpace(os.Getenv(cacheAdminTokenEnvKey))
+	log.Printf("[INFO] response cache config: maxBytes=%d entryMaxBytes=%d adminEndpointsEnabled=%t",
+		cacheMaxBytes, cacheEntryMaxBytes, cacheAdminToken != "")
+
+	// 限流后端同样依赖 .env（REDIS_URL 等）
+	defaultLimiter = loadLimiterFromEnv()
+
+	// 注册 Prometheus 指标，/metrics 由 promhttp.Handler() 暴露
+	prometheus.MustRegister(
+		metricRequestsTotal,
+		metricRequestDuration,
+		metricUpstreamErrors,
+		metricSocks5DialDuration,
+		metricRateLimitRejected,
+		metricBreakerState,
+	)
 }
 
-// 构造 http.Transport，视环境变量决定是否走 SOCKS5
+// parseSOCKS5URL 解析单个 socks5://[user:pass@]host:port，失败直接 FATAL（配置错误应该尽早暴露）
+func parseSOCKS5URL(envKey, raw string) (host, user, pass string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		log.Fatalf("[FATAL] invalid %s=%q: %v", envKey, raw, err)
+	}
+	if u.Scheme != "socks5" {
+		log.Fatalf("[FATAL] %s must start with socks5://, got: %q", envKey, raw)
+	}
+	if u.Host == "" {
+		log.Fatalf("[FATAL] %s missing host:port, got: %q", envKey, raw)
+	}
+
+	host = u.Host // 例如 154.17.227.135:8899
+	if u.User != nil {
+		user = u.User.Username()
+		pass, _ = u.User.Password()
+	}
+	return host, user, pass
+}
+
+// 构造 http.Transport，视环境变量决定是否走单个/多个 SOCKS5
 func newTransportWithOptionalSOCKS5() *http.Transport {
-	raw := strings.TrimSpace(os.Getenv(socks5EnvKey))
-	if raw == "" {
+	rawURLs := socks5URLsFromEnv()
+	if len(rawURLs) == 0 {
 		// 不配置 SOCKS5，就用系统默认（可读 HTTP_PROXY 等）
-		log.Printf("[INFO] %s not set, using direct/HTTP proxy from env", socks5EnvKey)
+		log.Printf("[INFO] %s/%s not set, using direct/HTTP proxy from env", socks5URLsEnvKey, socks5EnvKey)
 		tr := &http.Transport{
 			Proxy:                 http.ProxyFromEnvironment,
 			TLSHandshakeTimeout:   10 * time.Second,
@@ -135,65 +277,479 @@ func newTransportWithOptionalSOCKS5() *http.Transport {
 			ExpectContinueTimeout: 1 * time.Second,
 			ForceAttemptHTTP2:     true,
 		}
+		upstreamDialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext
 		return tr
 	}
 
-	u, err := url.Parse(raw)
-	if err != nil {
-		log.Fatalf("[FATAL] invalid %s=%q: %v", socks5EnvKey, raw, err)
+	baseDialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
 	}
 
-	if u.Scheme != "socks5" {
-		log.Fatalf("[FATAL] %s must start with socks5://, got: %q", socks5EnvKey, raw)
+	strategy := socks5StrategyFromEnv()
+	pool, err := newSOCKS5Pool(rawURLs, strategy, baseDialer)
+	if err != nil {
+		log.Fatalf("[FATAL] failed to build SOCKS5 pool: %v", err)
 	}
+	defaultSOCKS5Pool = pool
+	pool.startHealthChecks()
+	upstreamDialContext = pool.DialContext
 
-	if u.Host == "" {
-		log.Fatalf("[FATAL] %s missing host:port, got: %q", socks5EnvKey, raw)
+	log.Printf("[INFO] using %d SOCKS5 proxy(ies), strategy=%s", len(pool.proxies), strategy)
+
+	tr := &http.Transport{
+		Proxy:                 nil, // 使用 SOCKS5 时不再叠 HTTP 代理
+		DialContext:           pool.DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConns:          1024,
+		MaxIdleConnsPerHost:   256,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
 	}
+	return tr
+}
 
-	host := u.Host // 例如 154.17.227.135:8899
+// socks5URLsFromEnv 优先读取新的 SOCKS5_URLS（逗号分隔），兼容旧的单个 SOCKS5_URL
+func socks5URLsFromEnv() []string {
+	if raw := strings.TrimSpace(os.Getenv(socks5URLsEnvKey)); raw != "" {
+		var urls []string
+		for _, part := range strings.Split(raw, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				urls = append(urls, part)
+			}
+		}
+		return urls
+	}
+	if raw := strings.TrimSpace(os.Getenv(socks5EnvKey)); raw != "" {
+		return []string{raw}
+	}
+	return nil
+}
 
-	var user, pass string
-	if u.User != nil {
-		user = u.User.Username()
-		pass, _ = u.User.Password()
+// socks5StrategyFromEnv 读取 SOCKS5_STRATEGY，非法值回退 round_robin
+func socks5StrategyFromEnv() string {
+	strategy := strings.TrimSpace(os.Getenv(socks5StrategyEnvKey))
+	switch strategy {
+	case "round_robin", "random", "least_conn", "sticky_by_client_ip":
+		return strategy
+	case "":
+		return "round_robin"
+	default:
+		log.Printf("[WARN] invalid %s=%q, fallback to round_robin", socks5StrategyEnvKey, strategy)
+		return "round_robin"
 	}
+}
 
-	log.Printf("[INFO] using SOCKS5 proxy %s (user=%q)", host, user)
+// -------- SOCKS5 代理池（多出口 IP 轮换 + 健康检查）---------
 
-	baseDialer := &net.Dialer{
-		Timeout:   10 * time.Second,
-		KeepAlive: 30 * time.Second,
-	}
+// clientIPContextKey 是把客户端 IP 塞进 request context 的 key，供 sticky_by_client_ip 策略读取
+type clientIPContextKeyType struct{}
 
+var clientIPContextKey = clientIPContextKeyType{}
+
+// clientIPContextMiddleware 把 clientIP(r) 写进 context，这样 DialContext 里也能拿到，
+// 不用在 Director 里改 req 或者另外传参
+func clientIPContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey, clientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// socks5Proxy 代表池子里的一个出口，维护连续失败计数、健康状态和简单的延迟/连接数统计
+type socks5Proxy struct {
+	host   string
+	user   string
+	dialer proxy.Dialer
+
+	mu               sync.Mutex
+	consecutiveFails int
+	unhealthy        bool
+	lastErr          error
+
+	successCount   int64
+	failCount      int64
+	dialNanosTotal int64
+	dialSamples    int64
+	activeConns    int64 // atomic
+}
+
+func newSOCKS5Proxy(host, user, pass string, baseDialer *net.Dialer) (*socks5Proxy, error) {
 	var auth *proxy.Auth
 	if user != "" {
-		auth = &proxy.Auth{
-			User:     user,
-			Password: pass,
+		auth = &proxy.Auth{User: user, Password: pass}
+	}
+	dialer, err := proxy.SOCKS5("tcp", host, auth, baseDialer)
+	if err != nil {
+		return nil, fmt.Errorf("socks5 dialer for %s: %w", host, err)
+	}
+	return &socks5Proxy{host: host, user: user, dialer: dialer}, nil
+}
+
+func (p *socks5Proxy) healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.unhealthy
+}
+
+func (p *socks5Proxy) markSuccess(dialDuration time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consecutiveFails = 0
+	p.unhealthy = false
+	p.successCount++
+	p.dialNanosTotal += dialDuration.Nanoseconds()
+	p.dialSamples++
+}
+
+func (p *socks5Proxy) markFailure(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.consecutiveFails++
+	p.failCount++
+	p.lastErr = err
+	if p.consecutiveFails >= socks5FailThreshold {
+		p.unhealthy = true
+	}
+}
+
+// probe 尝试直接拨一次到探测目标，成功即视为恢复健康
+func (p *socks5Proxy) probe() {
+	start := time.Now()
+	conn, err := p.dialer.Dial("tcp", socks5ProbeTarget)
+	if err != nil {
+		p.markFailure(err)
+		return
+	}
+	_ = conn.Close()
+	p.markSuccess(time.Since(start))
+}
+
+// snapshot 是 /proxies 端点用的只读视图
+type socks5ProxyStatus struct {
+	Host          string `json:"host"`
+	User          string `json:"user,omitempty"`
+	Healthy       bool   `json:"healthy"`
+	LastError     string `json:"last_error,omitempty"`
+	SuccessCount  int64  `json:"success_count"`
+	FailCount     int64  `json:"fail_count"`
+	AvgDialMillis int64  `json:"avg_dial_ms"`
+	ActiveConns   int64  `json:"active_conns"`
+}
+
+func (p *socks5Proxy) snapshot() socks5ProxyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var avgMillis int64
+	if p.dialSamples > 0 {
+		avgMillis = (p.dialNanosTotal / p.dialSamples) / int64(time.Millisecond)
+	}
+	var lastErr string
+	if p.lastErr != nil {
+		lastErr = p.lastErr.Error()
+	}
+	return socks5ProxyStatus{
+		Host:          p.host,
+		User:          p.user,
+		Healthy:       !p.unhealthy,
+		LastError:     lastErr,
+		SuccessCount:  p.successCount,
+		FailCount:     p.failCount,
+		AvgDialMillis: avgMillis,
+		ActiveConns:   atomic.LoadInt64(&p.activeConns),
+	}
+}
+
+// trackingConn 在连接关闭时把所属代理的 activeConns 计数减回去，用于 least_conn 策略
+type trackingConn struct {
+	net.Conn
+	proxy *socks5Proxy
+}
+
+func (c *trackingConn) Close() error {
+	atomic.AddInt64(&c.proxy.activeConns, -1)
+	return c.Conn.Close()
+}
+
+// socks5Pool 管理一组 SOCKS5 出口，按策略为每次拨号挑一个健康的代理
+type socks5Pool struct {
+	proxies  []*socks5Proxy
+	strategy string
+	rrCursor uint64 // atomic，round_robin 用
+}
+
+func newSOCKS5Pool(rawURLs []string, strategy string, baseDialer *net.Dialer) (*socks5Pool, error) {
+	pool := &socks5Pool{strategy: strategy}
+	for _, raw := range rawURLs {
+		host, user, pass := parseSOCKS5URL(socks5URLsEnvKey, raw)
+		px, err := newSOCKS5Proxy(host, user, pass, baseDialer)
+		if err != nil {
+			return nil, err
+		}
+		pool.proxies = append(pool.proxies, px)
+	}
+	if len(pool.proxies) == 0 {
+		return nil, fmt.Errorf("no SOCKS5 proxies configured")
+	}
+	return pool, nil
+}
+
+// startHealthChecks 为每个代理起一个后台探测协程，定期给不健康的代理探活
+func (pool *socks5Pool) startHealthChecks() {
+	for _, px := range pool.proxies {
+		px := px
+		go func() {
+			ticker := time.NewTicker(socks5ProbeInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				if !px.healthy() {
+					px.probe()
+				}
+			}
+		}()
+	}
+}
+
+// pick 按策略选一个代理；如果所有代理都不健康，就退化成用全量代理，总比直接报错强
+func (pool *socks5Pool) pick(ctx context.Context) *socks5Proxy {
+	healthy := make([]*socks5Proxy, 0, len(pool.proxies))
+	for _, px := range pool.proxies {
+		if px.healthy() {
+			healthy = append(healthy, px)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = pool.proxies
+	}
+	if len(healthy) == 1 {
+		return healthy[0]
+	}
+
+	switch pool.strategy {
+	case "random":
+		return healthy[rand.Intn(len(healthy))]
+	case "least_conn":
+		best := healthy[0]
+		for _, px := range healthy[1:] {
+			if atomic.LoadInt64(&px.activeConns) < atomic.LoadInt64(&best.activeConns) {
+				best = px
+			}
 		}
+		return best
+	case "sticky_by_client_ip":
+		ip, _ := ctx.Value(clientIPContextKey).(string)
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(ip))
+		return healthy[h.Sum32()%uint32(len(healthy))]
+	default: // round_robin
+		n := atomic.AddUint64(&pool.rrCursor, 1)
+		return healthy[n%uint64(len(healthy))]
 	}
+}
+
+// DialContext 实现 http.Transport.DialContext，拨号之前选代理，拨号结果喂回代理的健康状态
+func (pool *socks5Pool) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	px := pool.pick(ctx)
 
-	socksDialer, err := proxy.SOCKS5("tcp", host, auth, baseDialer)
+	start := time.Now()
+	conn, err := px.dialer.Dial(network, addr)
+	dialDuration := time.Since(start)
+	if rm, ok := ctx.Value(requestMetricsContextKey).(*requestMetrics); ok {
+		rm.dialLatency = dialDuration
+		rm.socks5Proxy = px.host
+	}
 	if err != nil {
-		log.Fatalf("[FATAL] failed to create SOCKS5 dialer: %v", err)
+		px.markFailure(err)
+		return nil, err
 	}
+	px.markSuccess(dialDuration)
+	atomic.AddInt64(&px.activeConns, 1)
+	return &trackingConn{Conn: conn, proxy: px}, nil
+}
 
-	dialContext := func(ctx context.Context, network, addr string) (net.Conn, error) {
-		return socksDialer.Dial(network, addr)
+// snapshot 返回所有代理的状态，供 /proxies 端点使用
+func (pool *socks5Pool) snapshot() []socks5ProxyStatus {
+	statuses := make([]socks5ProxyStatus, 0, len(pool.proxies))
+	for _, px := range pool.proxies {
+		statuses = append(statuses, px.snapshot())
 	}
+	return statuses
+}
 
-	tr := &http.Transport{
-		Proxy:                 nil, // 使用 SOCKS5 时不再叠 HTTP 代理
-		DialContext:           dialContext,
-		TLSHandshakeTimeout:   10 * time.Second,
-		IdleConnTimeout:       90 * time.Second,
-		MaxIdleConns:          1024,
-		MaxIdleConnsPerHost:   256,
-		ExpectContinueTimeout: 1 * time.Second,
-		ForceAttemptHTTP2:     true,
+// 全局代理池，没配置 SOCKS5 时为 nil
+var defaultSOCKS5Pool *socks5Pool
+
+// proxiesHandler 展示 /proxies 端点：每个出口的健康状态、最近错误、成功/失败计数、平均拨号延迟。
+// 会暴露出口 host/user，和 /cache/* 一样需要 CACHE_ADMIN_TOKEN，不能让匿名客户端看到出口基础设施细节
+func proxiesHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCacheAdminToken(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if defaultSOCKS5Pool == nil {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"enabled": false, "proxies": []socks5ProxyStatus{}})
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":  true,
+		"strategy": defaultSOCKS5Pool.strategy,
+		"proxies":  defaultSOCKS5Pool.snapshot(),
+	})
+}
+
+// -------- WebSocket 透传（Hijack 之后直接转发字节流，不走 httputil.ReverseProxy）---------
+
+// upstreamDialContext 是当前生效的出口拨号方式（直连或 SOCKS5 代理池），
+// newTransportWithOptionalSOCKS5 会设置它，WebSocket 透传复用同一条出口，保持和普通请求一致的出口 IP 策略
+var upstreamDialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// upstreamTLSConfig 是和上游握手 TLS 时用的配置，默认只设置 ServerName；
+// 测试里可以替换成信任本地回声服务器证书的配置，不需要真的连 Google
+var upstreamTLSConfig = &tls.Config{ServerName: targetHost}
+
+// isWebSocketUpgrade 判断请求是不是 WebSocket 升级请求；Connection 可能是 "keep-alive, Upgrade" 这种组合值，
+// 所以用 Contains 而不是整串比较
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// proxyWebSocket 把客户端连接 Hijack 出来，用和普通请求相同的出口（直连/SOCKS5 代理池）与上游建立 TLS 连接，
+// 原样转发握手请求/响应（保留 Sec-WebSocket-* 头），然后在两个方向之间直接转发字节，不做任何帧解析
+func proxyWebSocket(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	dialCtx, cancel := context.WithTimeout(r.Context(), wsHandshakeTimeout)
+	defer cancel()
+
+	rawConn, err := upstreamDialContext(dialCtx, "tcp", targetHost+":443")
+	if err != nil {
+		log.Printf("[ERROR] websocket upstream dial failed: %v", err)
+		defaultBreakerRegistry.get(targetHost).RecordResult(false)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+
+	upstreamConn := tls.Client(rawConn, upstreamTLSConfig)
+	if err := upstreamConn.HandshakeContext(dialCtx); err != nil {
+		_ = rawConn.Close()
+		log.Printf("[ERROR] websocket upstream TLS handshake failed: %v", err)
+		defaultBreakerRegistry.get(targetHost).RecordResult(false)
+		http.Error(w, "Upstream error", http.StatusBadGateway)
+		return
+	}
+	defaultBreakerRegistry.get(targetHost).RecordResult(true)
+
+	clientConn, clientBuf, err := hj.Hijack()
+	if err != nil {
+		_ = upstreamConn.Close()
+		log.Printf("[ERROR] websocket hijack failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+	defer upstreamConn.Close()
+
+	// 确保目标地址 + Host，和 Director 里对普通请求的处理保持一致
+	r.URL.Scheme = "https"
+	r.URL.Host = targetHost
+	r.Host = targetHost
+
+	if err := r.Write(upstreamConn); err != nil {
+		log.Printf("[ERROR] websocket forward handshake request failed: %v", err)
+		return
+	}
+
+	upstreamReader := bufio.NewReader(upstreamConn)
+	resp, err := http.ReadResponse(upstreamReader, r)
+	if err != nil {
+		log.Printf("[ERROR] websocket read upstream handshake response failed: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := resp.Write(clientConn); err != nil {
+		log.Printf("[ERROR] websocket forward handshake response failed: %v", err)
+		return
+	}
+
+	// http.ReadResponse/客户端的 bufio.Reader 都可能已经把握手之后的第一批帧数据读进了缓冲区，
+	// 握手完成后要先把这些字节冲过去，否则后面纯字节转发会丢帧
+	if n := upstreamReader.Buffered(); n > 0 {
+		buffered, _ := upstreamReader.Peek(n)
+		_, _ = clientConn.Write(buffered)
+	}
+	if n := clientBuf.Reader.Buffered(); n > 0 {
+		buffered, _ := clientBuf.Reader.Peek(n)
+		_, _ = upstreamConn.Write(buffered)
+	}
+
+	errc := make(chan error, 2)
+	go wsRelay(upstreamConn, clientConn, errc)
+	go wsRelay(clientConn, upstreamConn, errc)
+	<-errc // 任意一个方向出错/断开就结束整个透传
+}
+
+// wsRelay 把 src 读到的字节原样写给 dst，每次读写都刷新空闲超时，避免半开连接占着资源不放
+func wsRelay(dst, src net.Conn, errc chan<- error) {
+	buf := make([]byte, 32*1024)
+	for {
+		_ = src.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+		n, err := src.Read(buf)
+		if n > 0 {
+			_ = dst.SetWriteDeadline(time.Now().Add(wsIdleTimeout))
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				errc <- werr
+				return
+			}
+		}
+		if err != nil {
+			errc <- err
+			return
+		}
+	}
+}
+
+// grpcWebFlushWriter 包一层 http.ResponseWriter：一旦响应的 Content-Type 是 application/grpc-web，
+// 每次 Write 之后立刻 Flush，效果等价于给这一种响应单独设置 FlushInterval = -1。
+// text/event-stream 不需要它，httputil.ReverseProxy 自己会按 Content-Type 识别并立即 flush
+type grpcWebFlushWriter struct {
+	http.ResponseWriter
+	flusher     http.Flusher
+	shouldFlush bool
+}
+
+func newGRPCWebFlushWriter(w http.ResponseWriter) http.ResponseWriter {
+	f, _ := w.(http.Flusher)
+	return &grpcWebFlushWriter{ResponseWriter: w, flusher: f}
+}
+
+func (w *grpcWebFlushWriter) WriteHeader(status int) {
+	if strings.HasPrefix(w.Header().Get("Content-Type"), "application/grpc-web") {
+		w.shouldFlush = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *grpcWebFlushWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.shouldFlush && w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return n, err
+}
+
+// Flush 透传给底层 ResponseWriter，这样 httputil.ReverseProxy 对 text/event-stream 的
+// 自动立即 flush 逻辑（它要求 dst 实现 http.Flusher）仍然正常工作
+func (w *grpcWebFlushWriter) Flush() {
+	if w.flusher != nil {
+		w.flusher.Flush()
 	}
-	return tr
 }
 
 // 构造反向代理
@@ -226,7 +782,7 @@ func newReverseProxy(target string) (*httputil.ReverseProxy, error) {
 		req.URL.Host = targetURL.Host
 		req.Host = targetURL.Host
 
-		// 去掉常见代理相关头
+		// 去掉常见代理相关头（注意：不能删 Connection/Upgrade，WebSocket 握手要靠它们协商）
 		for _, h := range []string{
 			"X-Real-IP",
 			"X-Forwarded-For",
@@ -256,12 +812,41 @@ func newReverseProxy(target string) (*httputil.ReverseProxy, error) {
 		}
 	}
 
-	// 使用我们自定义的 Transport（支持可选 SOCKS5）
-	proxyRP.Transport = newTransportWithOptionalSOCKS5()
+	// 使用我们自定义的 Transport（支持可选 SOCKS5），外层再包一层响应缓存
+	proxyRP.Transport = newCachingRoundTripper(newTransportWithOptionalSOCKS5(), defaultResponseCache)
 
-	// 统一错误处理
+	// SSE（text/event-stream）httputil.ReverseProxy 自己就会按 Content-Type 识别并立即 flush，
+	// 不需要我们设置 FlushInterval；而 FlushInterval 是全局的，设成 -1 会让所有响应（包括普通静态资源）
+	// 都逐块立即 flush，反而违背响应缓存想要的吞吐。application/grpc-web 标准库不认识，
+	// 下面用 grpcWebFlushWriter 单独按 Content-Type 只对它做立即 flush
+
+	// 响应回来后，按状态码喂给熔断器：5xx 记为失败，其余记为成功。
+	// 直接命中本地缓存的响应没有真的打到上游，不能算数——尤其是 Half-Open 期间，
+	// 命中缓存 cachingRoundTripper 已经绕过了（见 isBreakerProbe），这里双重保险
+	proxyRP.ModifyResponse = func(resp *http.Response) error {
+		if resp.Header.Get("X-Cache") == "HIT" {
+			return nil
+		}
+		success := resp.StatusCode < http.StatusInternalServerError
+		defaultBreakerRegistry.get(targetHost).RecordResult(success)
+		if !success {
+			metricUpstreamErrors.WithLabelValues("5xx").Inc()
+		}
+		return nil
+	}
+
+	// 统一错误处理（dial 失败、超时等也会走到这里，同样喂给熔断器）。
+	// 客户端自己断开连接（关标签页/导航走了）也会以 context.Canceled 的形式走到这里，
+	// 这不是上游故障，不能喂给熔断器，否则一堆正常的客户端中断就能把健康的上游熔断掉
 	proxyRP.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		if isClientDisconnectError(req, err) {
+			log.Printf("[INFO] client disconnected before upstream responded: %v", err)
+			http.Error(rw, "Upstream error", http.StatusBadGateway)
+			return
+		}
 		log.Printf("[ERROR] proxy error: %v", err)
+		defaultBreakerRegistry.get(targetHost).RecordResult(false)
+		metricUpstreamErrors.WithLabelValues(classifyUpstreamError(err)).Inc()
 		http.Error(rw, "Upstream error", http.StatusBadGateway)
 	}
 
@@ -303,19 +888,179 @@ func clientIP(r *http.Request) string {
 	return host
 }
 
-// loggingMiddleware 统一请求访问日志（info 级别）仅记录 IP 和 UA
+// -------- Prometheus 指标 ---------
+
+var (
+	metricRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Total number of proxied requests.",
+	}, []string{"method", "status", "cache"})
+
+	metricRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "End-to-end latency of proxied requests, from accept to last byte written.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	metricUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Upstream errors seen by the reverse proxy, by reason.",
+	}, []string{"reason"})
+
+	metricSocks5DialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_socks5_dial_duration_seconds",
+		Help:    "Dial latency through each configured SOCKS5 proxy.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proxy"})
+
+	metricRateLimitRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ratelimit_rejected_total",
+		Help: "Total number of requests rejected by the rate limiter.",
+	})
+
+	metricBreakerState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "breaker_state",
+		Help: "Circuit breaker state per upstream host: 0=closed, 1=half-open, 2=open.",
+	}, []string{"upstream"})
+)
+
+// breakerStateValue 把熔断器状态映射成 breaker_state 指标用的数值
+func breakerStateValue(s breakerState) float64 {
+	switch s {
+	case breakerOpen:
+		return 2
+	case breakerHalfOpen:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// classifyUpstreamError 把 ErrorHandler 收到的错误归类成 proxy_upstream_errors_total 的 reason 标签
+func classifyUpstreamError(err error) string {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return "timeout"
+	}
+	return "dial_error"
+}
+
+// isClientDisconnectError 判断 ErrorHandler 收到的错误是不是客户端自己断开连接导致的
+// （关标签页、导航走了），而不是真正的上游故障：这种情况下 inbound request 的 context
+// 在 RoundTrip 半路就被取消，RoundTrip 会原样把 context.Canceled 冒泡上来
+func isClientDisconnectError(req *http.Request, err error) bool {
+	if req.Context().Err() != nil {
+		return true
+	}
+	return errors.Is(err, context.Canceled)
+}
+
+// requestMetricsContextKeyType 用于把 *requestMetrics 塞进 request context
+type requestMetricsContextKeyType struct{}
+
+var requestMetricsContextKey = requestMetricsContextKeyType{}
+
+// requestMetrics 收集一次请求在穿过各层中间件/Transport 过程中产生的、中间件自己拿不到的数据
+// （SOCKS5 拨号延迟、用了哪个出口），通过 context 传下去，处理完再由 loggingMiddleware 读出来
+type requestMetrics struct {
+	dialLatency time.Duration
+	socks5Proxy string
+}
+
+// statusRecorder 包一层 http.ResponseWriter，记录状态码和写出的字节数；
+// 同时把 Hijacker/Flusher 转发给底层，不破坏 WebSocket 透传和流式响应
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.wroteHeader = true
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.status = http.StatusOK
+		rec.wroteHeader = true
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("underlying ResponseWriter does not support hijacking")
+	}
+	return hj.Hijack()
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// loggingMiddleware 记录 Prometheus 指标，并把结构化访问日志异步写到 access-YYYY-MM-DD.log
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		next.ServeHTTP(w, r)
+		start := time.Now()
 
-		ip := clientIP(r)
-		ua := r.Header.Get("User-Agent")
+		rm := &requestMetrics{}
+		ctx := context.WithValue(r.Context(), requestMetricsContextKey, rm)
+		r = r.WithContext(ctx)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		latency := time.Since(start)
+		cacheStatus := rec.Header().Get("X-Cache")
+		if cacheStatus == "" {
+			cacheStatus = "-"
+		}
+
+		metricRequestsTotal.WithLabelValues(r.Method, strconv.Itoa(rec.status), cacheStatus).Inc()
+		metricRequestDuration.Observe(latency.Seconds())
+		if rm.socks5Proxy != "" {
+			metricSocks5DialDuration.WithLabelValues(rm.socks5Proxy).Observe(rm.dialLatency.Seconds())
+		}
+
+		rateLimitDecision := "allow"
+		if rec.status == http.StatusTooManyRequests {
+			rateLimitDecision = "deny"
+		}
+
+		breakerStateLabel := "closed"
+		switch defaultBreakerRegistry.get(targetHost).State() {
+		case breakerOpen:
+			breakerStateLabel = "open"
+		case breakerHalfOpen:
+			breakerStateLabel = "half_open"
+		}
 
 		// 访问日志单独写到 access-YYYY-MM-DD.log（异步，避免阻塞请求）
 		if accessLogCh != nil {
-			msg := fmt.Sprintf("[INFO] access: ip=%s ua=%q", ip, ua)
+			ev := accessEvent{
+				timestamp:         start,
+				clientIP:          clientIP(r),
+				method:            r.Method,
+				path:              r.URL.Path,
+				upstreamStatus:    rec.status,
+				bytesIn:           r.ContentLength,
+				bytesOut:          rec.bytes,
+				totalLatency:      latency,
+				dialLatency:       rm.dialLatency,
+				socks5Proxy:       rm.socks5Proxy,
+				cacheStatus:       cacheStatus,
+				breakerState:      breakerStateLabel,
+				rateLimitDecision: rateLimitDecision,
+			}
 			select {
-			case accessLogCh <- msg:
+			case accessLogCh <- ev:
 			default:
 				// 队列满了就丢弃，保证代理转发不被日志拖慢
 			}
@@ -323,13 +1068,28 @@ func loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// -------- IP 级限流（内存实现）---------
+// -------- IP 级限流（pluggable Limiter：memory / redis）---------
+
+// RateLimitResult 是一次限流判定的结果，足够中间件拼出 X-RateLimit-* 响应头
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	ResetAt   time.Time
+}
+
+// Limiter 是限流后端的抽象，内存令牌桶和 Redis 滑动窗口都实现它，
+// 这样多实例部署时只需要切后端就能共享限流状态，不用改调用方代码
+type Limiter interface {
+	Allow(ctx context.Context, ip string) (RateLimitResult, error)
+}
 
-// ipRateLimiter 针对单个 IP 的令牌桶限流，适合高并发下的近似精确控制
+// ipRateLimiter 针对单个 IP 的令牌桶限流，适合高并发下的近似精确控制；作为 memory 后端
 type ipRateLimiter struct {
 	mu      sync.Mutex
 	limit   float64            // 桶容量（最大令牌数），即窗口内允许的最大请求数
 	rate    float64            // 每秒填充令牌数
+	window  time.Duration      // 仅用于估算 ResetAt
 	buckets map[string]*bucket // 每个 IP 一个桶
 }
 
@@ -340,19 +1100,20 @@ type bucket struct {
 
 func newIPRateLimiter(maxReq int, window time.Duration) *ipRateLimiter {
 	if window <= 0 {
-		window = 10 * time.Second
+		window = defaultRateLimitWindow
 	}
 	limit := float64(maxReq)
 	rate := limit / window.Seconds()
 	return &ipRateLimiter{
 		limit:   limit,
 		rate:    rate,
+		window:  window,
 		buckets: make(map[string]*bucket),
 	}
 }
 
 // Allow 返回是否允许当前 IP 通过，超过限额返回 false
-func (rl *ipRateLimiter) Allow(ip string) bool {
+func (rl *ipRateLimiter) Allow(ip string) RateLimitResult {
 	now := time.Now()
 
 	rl.mu.Lock()
@@ -361,40 +1122,189 @@ func (rl *ipRateLimiter) Allow(ip string) bool {
 	b, ok := rl.buckets[ip]
 	if !ok {
 		// 首次出现的 IP，给满桶，直接通过
-		rl.buckets[ip] = &bucket{
-			tokens: rl.limit - 1, // 预扣 1 个
-			last:   now,
+		b = &bucket{tokens: rl.limit, last: now}
+		rl.buckets[ip] = b
+	} else {
+		// 根据时间间隔补充令牌
+		elapsed := now.Sub(b.last).Seconds()
+		if elapsed > 0 {
+			b.tokens += elapsed * rl.rate
+			if b.tokens > rl.limit {
+				b.tokens = rl.limit
+			}
+			b.last = now
 		}
-		return true
 	}
 
-	// 根据时间间隔补充令牌
-	elapsed := now.Sub(b.last).Seconds()
-	if elapsed > 0 {
-		b.tokens += elapsed * rl.rate
-		if b.tokens > rl.limit {
-			b.tokens = rl.limit
+	if b.tokens < 1 {
+		resetIn := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+		return RateLimitResult{Allowed: false, Limit: int(rl.limit), Remaining: 0, ResetAt: now.Add(resetIn)}
+	}
+
+	b.tokens--
+	return RateLimitResult{
+		Allowed:   true,
+		Limit:     int(rl.limit),
+		Remaining: int(b.tokens),
+		ResetAt:   now.Add(rl.window),
+	}
+}
+
+// memoryLimiter 把 ipRateLimiter 适配成 Limiter 接口
+type memoryLimiter struct {
+	rl *ipRateLimiter
+}
+
+func newMemoryLimiter(maxReq int, window time.Duration) *memoryLimiter {
+	return &memoryLimiter{rl: newIPRateLimiter(maxReq, window)}
+}
+
+func (m *memoryLimiter) Allow(_ context.Context, ip string) (RateLimitResult, error) {
+	return m.rl.Allow(ip), nil
+}
+
+// redisSlidingWindowScript 原子地做滑动窗口计数：
+// 1) 清掉窗口外的旧成员 2) 数当前窗口内的请求数 3) 没超限就记一次并续期，超限则返回最旧成员的分数方便算 Retry-After
+const redisSlidingWindowScript = `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+if count < limit then
+	redis.call('ZADD', key, now, now .. '-' .. redis.call('INCR', key .. ':seq'))
+	redis.call('PEXPIRE', key, window)
+	redis.call('PEXPIRE', key .. ':seq', window)
+	return {1, count + 1, 0}
+end
+
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+local oldestScore = 0
+if oldest[2] ~= nil then
+	oldestScore = tonumber(oldest[2])
+end
+return {0, count, oldestScore}
+`
+
+// redisLimiter 基于 Redis 有序集合的滑动窗口限流，供多个 google-proxy 实例共享状态；
+// 内部用一个 circuitBreaker 盯着 Redis 本身的健康状况，避免 Redis 抖动时每个请求都去付超时的代价
+type redisLimiter struct {
+	client   *redis.Client
+	script   *redis.Script
+	limit    int
+	window   time.Duration
+	fallback *memoryLimiter
+	breaker  *circuitBreaker
+}
+
+func newRedisLimiter(client *redis.Client, limit int, window time.Duration, fallback *memoryLimiter) *redisLimiter {
+	return &redisLimiter{
+		client:   client,
+		script:   redis.NewScript(redisSlidingWindowScript),
+		limit:    limit,
+		window:   window,
+		fallback: fallback,
+		breaker:  newCircuitBreaker(redisBreakerFailRatio, redisBreakerMinSamples, redisBreakerCooldown),
+	}
+}
+
+func (rl *redisLimiter) Allow(ctx context.Context, ip string) (RateLimitResult, error) {
+	if allow, _ := rl.breaker.Allow(); !allow {
+		// Redis 最近故障率太高，直接退回内存限流，不再浪费一次 Redis 超时
+		return rl.fallback.Allow(ctx, ip)
+	}
+
+	key := fmt.Sprintf("rl:{%s}", ip)
+	now := time.Now()
+	windowMs := rl.window.Milliseconds()
+
+	res, err := rl.script.Run(ctx, rl.client, []string{key}, now.UnixMilli(), windowMs, rl.limit).Result()
+	if err != nil {
+		rl.breaker.RecordResult(false)
+		log.Printf("[WARN] redis rate limiter unavailable, falling back to memory: %v", err)
+		return rl.fallback.Allow(ctx, ip)
+	}
+	rl.breaker.RecordResult(true)
+
+	values, ok := res.([]interface{})
+	if !ok || len(values) != 3 {
+		log.Printf("[WARN] unexpected redis rate limiter reply: %v", res)
+		return rl.fallback.Allow(ctx, ip)
+	}
+
+	allowed, _ := values[0].(int64)
+	count, _ := values[1].(int64)
+	oldestMs, _ := values[2].(int64)
+
+	if allowed == 1 {
+		remaining := rl.limit - int(count)
+		if remaining < 0 {
+			remaining = 0
 		}
-		b.last = now
+		return RateLimitResult{Allowed: true, Limit: rl.limit, Remaining: remaining, ResetAt: now.Add(rl.window)}, nil
 	}
 
-	if b.tokens < 1 {
-		// 没有足够令牌，拒绝请求
-		return false
+	resetAt := now.Add(rl.window)
+	if oldestMs > 0 {
+		resetAt = time.UnixMilli(oldestMs).Add(rl.window)
 	}
+	return RateLimitResult{Allowed: false, Limit: rl.limit, Remaining: 0, ResetAt: resetAt}, nil
+}
 
-	b.tokens--
-	return true
+// loadLimiterFromEnv 根据 RATE_LIMIT_BACKEND 选择限流后端；redis 不可用时直接退回 memory
+func loadLimiterFromEnv() Limiter {
+	memory := newMemoryLimiter(defaultRateLimitMaxRequests, defaultRateLimitWindow)
+
+	backend := strings.ToLower(strings.TrimSpace(os.Getenv(rateLimitBackendEnvKey)))
+	if backend != "redis" {
+		return memory
+	}
+
+	redisURL := strings.TrimSpace(os.Getenv(redisURLEnvKey))
+	if redisURL == "" {
+		log.Printf("[WARN] %s=redis but %s is empty, falling back to memory limiter", rateLimitBackendEnvKey, redisURLEnvKey)
+		return memory
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		log.Printf("[WARN] invalid %s=%q: %v, falling back to memory limiter", redisURLEnvKey, redisURL, err)
+		return memory
+	}
+
+	log.Printf("[INFO] using redis rate limiter backend at %s", opts.Addr)
+	client := redis.NewClient(opts)
+	return newRedisLimiter(client, defaultRateLimitMaxRequests, defaultRateLimitWindow, memory)
 }
 
-// 全局默认：每 IP 每 10 秒最多 300 次（约 30 QPS）
-var defaultIPLimiter = newIPRateLimiter(300, 10*time.Second)
+// 全局限流器，init() 中根据环境变量选择后端
+var defaultLimiter Limiter
 
-// rateLimitMiddleware 在内存中对 IP 做限流
+// rateLimitMiddleware 对 IP 做限流，并把结果透出到 X-RateLimit-* 响应头
 func rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ip := clientIP(r)
-		if !defaultIPLimiter.Allow(ip) {
+		result, err := defaultLimiter.Allow(r.Context(), ip)
+		if err != nil {
+			// 限流器本身出错时放行，避免把限流故障放大成全站不可用
+			log.Printf("[ERROR] rate limiter error, failing open: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(result.ResetAt.Unix(), 10))
+
+		if !result.Allowed {
+			retryAfter := int(time.Until(result.ResetAt).Seconds())
+			if retryAfter < 0 {
+				retryAfter = 0
+			}
+			metricRateLimitRejected.Inc()
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 			w.WriteHeader(http.StatusTooManyRequests)
 			_, _ = w.Write([]byte("Too Many Requests\n"))
@@ -405,6 +1315,645 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// -------- 熔断器（按上游 host 维度）---------
+
+// breakerState 熔断器状态：Closed 正常放行 -> Open 直接拒绝 -> Half-Open 放探测请求
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerEvent 记录 Closed 状态下滚动窗口内的一次请求结果
+type breakerEvent struct {
+	at     time.Time
+	failed bool
+}
+
+// circuitBreaker 针对单个上游 host 的熔断器
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	failRatio    float64       // 触发熔断的失败率阈值
+	minSamples   int           // 触发判定所需的最小样本数
+	baseCooldown time.Duration // Open 状态的基础冷却时间
+	cooldown     time.Duration // 当前实际使用的冷却时间，失败会指数增长，封顶 breakerMaxCooldown
+
+	state    breakerState
+	events   []breakerEvent // 仅 Closed 状态下使用的滚动窗口样本
+	openedAt time.Time
+
+	halfOpenProbes   int // Half-Open 允许放行的探测请求数
+	halfOpenInFlight int // 已经放出去、尚未知道结果的探测数
+	halfOpenSuccess  int // 已经成功的探测数
+}
+
+func newCircuitBreaker(failRatio float64, minSamples int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		failRatio:      failRatio,
+		minSamples:     minSamples,
+		baseCooldown:   cooldown,
+		cooldown:       cooldown,
+		halfOpenProbes: breakerHalfOpenProbes,
+	}
+}
+
+// Allow 判断当前是否放行请求；Open 状态下直接拒绝并返回剩余冷却时间
+func (cb *circuitBreaker) Allow() (bool, time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		remaining := cb.cooldown - time.Since(cb.openedAt)
+		if remaining > 0 {
+			return false, remaining
+		}
+		// 冷却结束，转入 Half-Open，重新开始计数探测请求
+		cb.state = breakerHalfOpen
+		cb.halfOpenInFlight = 0
+		cb.halfOpenSuccess = 0
+		fallthrough
+	case breakerHalfOpen:
+		if cb.halfOpenInFlight >= cb.halfOpenProbes {
+			return false, cb.cooldown
+		}
+		cb.halfOpenInFlight++
+		return true, 0
+	default: // breakerClosed
+		return true, 0
+	}
+}
+
+// RecordResult 记录一次请求的成功/失败，驱动状态迁移
+func (cb *circuitBreaker) RecordResult(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := time.Now()
+
+	if cb.state == breakerHalfOpen {
+		if !success {
+			// 探测期间任意一次失败，立即重新打开并让冷却时间指数退避
+			cb.tripLocked(now)
+			return
+		}
+		cb.halfOpenSuccess++
+		if cb.halfOpenSuccess >= cb.halfOpenProbes {
+			// 全部探测成功，恢复 Closed 并把冷却时间重置回基础值
+			cb.state = breakerClosed
+			cb.cooldown = cb.baseCooldown
+			cb.events = cb.events[:0]
+		}
+		return
+	}
+
+	if cb.state != breakerClosed {
+		// Open 状态下仍可能收到 ErrorHandler/ModifyResponse 的滞后结果，忽略即可
+		return
+	}
+
+	cb.events = append(cb.events, breakerEvent{at: now, failed: !success})
+	cb.pruneLocked(now)
+	if len(cb.events) < cb.minSamples {
+		return
+	}
+
+	failed := 0
+	for _, e := range cb.events {
+		if e.failed {
+			failed++
+		}
+	}
+	if float64(failed)/float64(len(cb.events)) > cb.failRatio {
+		cb.tripLocked(now)
+	}
+}
+
+// pruneLocked 丢弃滚动窗口之外的旧样本，调用前必须持有锁
+func (cb *circuitBreaker) pruneLocked(now time.Time) {
+	cutoff := now.Add(-breakerWindow)
+	i := 0
+	for ; i < len(cb.events); i++ {
+		if cb.events[i].at.After(cutoff) {
+			break
+		}
+	}
+	if i > 0 {
+		cb.events = cb.events[i:]
+	}
+}
+
+// tripLocked 打开熔断器并让冷却时间指数退避（封顶 breakerMaxCooldown），调用前必须持有锁
+func (cb *circuitBreaker) tripLocked(now time.Time) {
+	if cb.state == breakerHalfOpen {
+		cb.cooldown *= 2
+		if cb.cooldown > breakerMaxCooldown {
+			cb.cooldown = breakerMaxCooldown
+		}
+	}
+	cb.state = breakerOpen
+	cb.openedAt = now
+	cb.events = cb.events[:0]
+}
+
+// State 返回当前状态，供 /metrics 的 breaker_state 和访问日志使用
+func (cb *circuitBreaker) State() breakerState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// breakerRegistry 按上游 host 维护独立的熔断器实例
+type breakerRegistry struct {
+	mu         sync.Mutex
+	breakers   map[string]*circuitBreaker
+	failRatio  float64
+	minSamples int
+	cooldown   time.Duration
+}
+
+func newBreakerRegistry(failRatio float64, minSamples int, cooldown time.Duration) *breakerRegistry {
+	return &breakerRegistry{
+		breakers:   make(map[string]*circuitBreaker),
+		failRatio:  failRatio,
+		minSamples: minSamples,
+		cooldown:   cooldown,
+	}
+}
+
+func (r *breakerRegistry) get(host string) *circuitBreaker {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cb, ok := r.breakers[host]
+	if !ok {
+		cb = newCircuitBreaker(r.failRatio, r.minSamples, r.cooldown)
+		r.breakers[host] = cb
+	}
+	return cb
+}
+
+// loadBreakerConfigFromEnv 读取熔断器阈值配置，取值缺失或非法时回退默认值
+func loadBreakerConfigFromEnv() (failRatio float64, minSamples int, cooldown time.Duration) {
+	failRatio = defaultBreakerFailRatio
+	if raw := strings.TrimSpace(os.Getenv(breakerFailRatioEnvKey)); raw != "" {
+		if v, err := strconv.ParseFloat(raw, 64); err == nil && v > 0 && v <= 1 {
+			failRatio = v
+		} else {
+			log.Printf("[WARN] invalid %s=%q, fallback to %.2f", breakerFailRatioEnvKey, raw, failRatio)
+		}
+	}
+
+	minSamples = defaultBreakerMinSamples
+	if raw := strings.TrimSpace(os.Getenv(breakerMinSamplesEnvKey)); raw != "" {
+		if v, err := strconv.Atoi(raw); err == nil && v > 0 {
+			minSamples = v
+		} else {
+			log.Printf("[WARN] invalid %s=%q, fallback to %d", breakerMinSamplesEnvKey, raw, minSamples)
+		}
+	}
+
+	cooldown = defaultBreakerCooldown
+	if raw := strings.TrimSpace(os.Getenv(breakerCooldownEnvKey)); raw != "" {
+		if v, err := time.ParseDuration(raw); err == nil && v > 0 {
+			cooldown = v
+		} else {
+			log.Printf("[WARN] invalid %s=%q, fallback to %s", breakerCooldownEnvKey, raw, cooldown)
+		}
+	}
+
+	return
+}
+
+// 全局熔断器注册表，init() 中读取环境变量后初始化
+var defaultBreakerRegistry *breakerRegistry
+
+// breakerProbeContextKey 标记一个请求是 Half-Open 期间放出来的探测请求，
+// 供 cachingRoundTripper 绕过缓存——探测请求必须真正打到上游，不能被一次缓存命中糊弄过去
+type breakerProbeContextKeyType struct{}
+
+var breakerProbeContextKey = breakerProbeContextKeyType{}
+
+func isBreakerProbe(ctx context.Context) bool {
+	v, _ := ctx.Value(breakerProbeContextKey).(bool)
+	return v
+}
+
+// breakerMiddleware 在请求真正发起 SOCKS5 拨号之前检查熔断器状态，Open 状态下直接拒绝，
+// 避免用一个已知在故障的出口 IP 反复浪费连接和超时预算
+func breakerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cb := defaultBreakerRegistry.get(targetHost)
+		allow, retryAfter := cb.Allow()
+		state := cb.State()
+		metricBreakerState.WithLabelValues(targetHost).Set(breakerStateValue(state))
+
+		if !allow {
+			w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("Upstream circuit breaker open\n"))
+			return
+		}
+
+		if state == breakerHalfOpen {
+			r = r.WithContext(context.WithValue(r.Context(), breakerProbeContextKey, true))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// -------- 响应缓存（LRU + TTL，包在 Transport 外层）---------
+
+// varySafeHeaders 是我们认为可以安全支持的 Vary 维度；出现其他维度时直接跳过缓存，
+// 避免在不理解的维度上把错误的内容返回给别的客户端
+var varySafeHeaders = map[string]bool{
+	"accept-encoding": true,
+	"accept-language": true,
+	"accept":          true,
+}
+
+// cacheEntry 缓存中的一条响应
+type cacheEntry struct {
+	status       int
+	header       http.Header
+	body         []byte
+	size         int64
+	expiresAt    time.Time
+	ttl          time.Duration // 原始 TTL，条件请求命中 304 但新响应没带缓存头时用它续期
+	etag         string
+	lastModified string
+}
+
+// toResponse 把缓存条目还原成一个可以直接返回给调用方的 *http.Response
+func (e *cacheEntry) toResponse(req *http.Request) *http.Response {
+	header := e.header.Clone()
+	header.Set("X-Cache", "HIT")
+	return &http.Response{
+		Status:        http.StatusText(e.status),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// responseCache 固定容量的 LRU，按字节数逐出，条目各自带独立 TTL
+type responseCache struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	maxBytes int64
+	curBytes int64
+	entryMax int64
+	hits     int64
+	misses   int64
+}
+
+func newResponseCache(maxBytes, entryMax int64) *responseCache {
+	return &responseCache{
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		maxBytes: maxBytes,
+		entryMax: entryMax,
+	}
+}
+
+// get 查找缓存条目；无论是否仍在有效期内都会返回，由调用方结合 expiresAt 判断新鲜度，
+// 这样即使过期了也能用其中的 ETag/Last-Modified 发起条件请求
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	return el.Value.(*lruItem).entry, true
+}
+
+type lruItem struct {
+	key   string
+	entry *cacheEntry
+}
+
+// set 写入/替换一条缓存，并在超出整体容量时从 LRU 尾部逐出
+func (c *responseCache) set(key string, entry *cacheEntry) {
+	if entry.size > c.entryMax {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		old := el.Value.(*lruItem).entry
+		c.curBytes -= old.size
+		el.Value.(*lruItem).entry = entry
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&lruItem{key: key, entry: entry})
+		c.items[key] = el
+	}
+	c.curBytes += entry.size
+
+	for c.curBytes > c.maxBytes {
+		back := c.ll.Back()
+		if back == nil {
+			break
+		}
+		item := back.Value.(*lruItem)
+		c.ll.Remove(back)
+		delete(c.items, item.key)
+		c.curBytes -= item.entry.size
+	}
+}
+
+// purge 清空整个缓存（/cache/purge 用）
+func (c *responseCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.curBytes = 0
+}
+
+// stats 返回 /cache/stats 展示用的统计数据
+func (c *responseCache) stats() (entries int, bytes int64, maxBytes int64, hits int64, misses int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.items), c.curBytes, c.maxBytes, c.hits, c.misses
+}
+
+// cacheKey 用 method+host+path+query+Accept+Accept-Language+Accept-Encoding 算一个缓存 key；
+// 这三个头必须和 varySafeHeaders 保持一致，否则 Vary 判断为安全的维度实际上没有被 key 区分开
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%s\n%s\n%s",
+		req.Method, req.URL.Host, req.URL.Path, req.URL.RawQuery,
+		req.Header.Get("Accept"), req.Header.Get("Accept-Language"), req.Header.Get("Accept-Encoding"))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isVarySafe 判断响应的 Vary 头是否都落在我们缓存 key 已经覆盖的维度内
+func isVarySafe(header http.Header) bool {
+	vary := header.Get("Vary")
+	if vary == "" {
+		return true
+	}
+	for _, part := range strings.Split(vary, ",") {
+		name := strings.ToLower(strings.TrimSpace(part))
+		if name == "*" || !varySafeHeaders[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// parseCacheControl 把 Cache-Control 头拆成 directive -> value 的 map（没有 value 的项 value 为空字符串）
+func parseCacheControl(v string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(v, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if k, val, ok := strings.Cut(part, "="); ok {
+			directives[strings.ToLower(strings.TrimSpace(k))] = strings.Trim(strings.TrimSpace(val), `"`)
+		} else {
+			directives[strings.ToLower(part)] = ""
+		}
+	}
+	return directives
+}
+
+// cacheTTLFromHeaders 根据 Cache-Control/Expires 计算这个响应还能缓存多久，返回 0 表示不可缓存
+func cacheTTLFromHeaders(header http.Header, fallback time.Duration) time.Duration {
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0
+	}
+	if _, ok := cc["no-cache"]; ok {
+		return 0
+	}
+	if _, ok := cc["private"]; ok {
+		return 0
+	}
+	if raw, ok := cc["max-age"]; ok {
+		secs, err := strconv.Atoi(raw)
+		if err != nil || secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if exp := header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			return 0
+		}
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return fallback
+}
+
+// cachingRoundTripper 包在真正的 Transport 外面，对 GET 请求做缓存命中/回源/条件请求
+type cachingRoundTripper struct {
+	base  http.RoundTripper
+	cache *responseCache
+}
+
+func newCachingRoundTripper(base http.RoundTripper, cache *responseCache) *cachingRoundTripper {
+	return &cachingRoundTripper{base: base, cache: cache}
+}
+
+func (t *cachingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return t.base.RoundTrip(req)
+	}
+
+	// 熔断器 Half-Open 期间放出来的探测请求必须真正验证上游，不能被缓存命中糊弄过去，
+	// 否则几个静态资源的缓存命中就能在上游还没真的恢复时把熔断器关回去
+	isProbe := isBreakerProbe(req.Context())
+
+	key := cacheKey(req)
+	entry, found := t.cache.get(key)
+	if !isProbe && found && time.Now().Before(entry.expiresAt) {
+		return entry.toResponse(req), nil
+	}
+	if isProbe {
+		found = false
+	}
+
+	upstreamReq := req
+	if found {
+		// 有旧副本但已过期，带上条件请求头尝试 304 revalidate，省去重新传输 body
+		upstreamReq = req.Clone(req.Context())
+		if entry.etag != "" {
+			upstreamReq.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			upstreamReq.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := t.base.RoundTrip(upstreamReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if found && resp.StatusCode == http.StatusNotModified {
+		_ = resp.Body.Close()
+		// entry 是缓存里共享的指针，可能被其他 goroutine 并发读到；不能就地改 expiresAt，
+		// 否则并发 revalidate 同一个热点资源会在这个字段上产生数据竞争。复制一份再写回
+		renewed := *entry
+		renewed.expiresAt = time.Now().Add(cacheTTLFromHeaders(resp.Header, entry.ttl))
+		t.cache.set(key, &renewed)
+		return renewed.toResponse(req), nil
+	}
+
+	t.maybeStore(key, resp)
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
+
+// maybeStore 判断响应是否可缓存并写入；不可缓存或超过单条大小上限时原样放行，不影响客户端拿到完整响应
+func (t *cachingRoundTripper) maybeStore(key string, resp *http.Response) {
+	if resp.Request.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return
+	}
+	if !isVarySafe(resp.Header) {
+		return
+	}
+	ttl := cacheTTLFromHeaders(resp.Header, 0)
+	if ttl <= 0 {
+		return
+	}
+	if resp.ContentLength > t.cache.entryMax {
+		return
+	}
+
+	limit := t.cache.entryMax + 1
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+	_ = resp.Body.Close()
+	if err != nil {
+		// 读取失败就放弃缓存，给客户端一个空 body 总比挂起强；上层的 ErrorHandler 会记录这次失败
+		resp.Body = io.NopCloser(bytes.NewReader(nil))
+		return
+	}
+
+	if int64(len(data)) > t.cache.entryMax {
+		// 超过单条大小上限，不缓存，但要把已经读出来的字节还给客户端
+		resp.Body = io.NopCloser(bytes.NewReader(data))
+		return
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+
+	t.cache.set(key, &cacheEntry{
+		status:       resp.StatusCode,
+		header:       resp.Header.Clone(),
+		body:         data,
+		size:         int64(len(data)),
+		expiresAt:    time.Now().Add(ttl),
+		ttl:          ttl,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	})
+}
+
+// loadCacheConfigFromEnv 读取响应缓存容量配置，取值缺失或非法时回退默认值
+func loadCacheConfigFromEnv() (maxBytes, entryMaxBytes int64) {
+	maxBytes = defaultCacheMaxBytes
+	if raw := strings.TrimSpace(os.Getenv(cacheMaxBytesEnvKey)); raw != "" {
+		if v, err := strconv.ParseInt(raw, 10, 64); err == nil && v > 0 {
+			maxBytes = v
+		} else {
+			log.Printf("[WARN] invalid %s=%q, fallback to %d", cacheMaxBytesEnvKey, raw, maxBytes)
+		}
+	}
+
+	entryMaxBytes = defaultCacheEntryMaxBytes
+	if raw := strings.TrimSpace(os.Getenv(cacheEntryMaxBytesEnvKey)); raw != "" {
+		if v, err := strconv.ParseInt(raw, 10, 64); err == nil && v > 0 {
+			entryMaxBytes = v
+		} else {
+			log.Printf("[WARN] invalid %s=%q, fallback to %d", cacheEntryMaxBytesEnvKey, raw, entryMaxBytes)
+		}
+	}
+
+	return
+}
+
+// 全局响应缓存和管理端点 token，init() 中读取环境变量后初始化
+var defaultResponseCache *responseCache
+var cacheAdminToken string
+
+// requireCacheAdminToken 校验 /cache/* 管理端点的访问令牌；没配置 token 时端点直接 404，避免误暴露
+func requireCacheAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if cacheAdminToken == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	if subtleTokenEqual(r.Header.Get("X-Admin-Token"), cacheAdminToken) {
+		return true
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return false
+}
+
+// subtleTokenEqual 简单的 token 比较（管理端点量级不需要引入额外依赖做恒定时间比较）
+func subtleTokenEqual(a, b string) bool {
+	return a != "" && a == b
+}
+
+// cacheStatsHandler 返回 /cache/stats 的 JSON 统计
+func cacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCacheAdminToken(w, r) {
+		return
+	}
+
+	entries, curBytes, maxBytes, hits, misses := defaultResponseCache.stats()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":   entries,
+		"bytes":     curBytes,
+		"max_bytes": maxBytes,
+		"hits":      hits,
+		"misses":    misses,
+	})
+}
+
+// cachePurgeHandler 清空响应缓存，供 /cache/purge 使用
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireCacheAdminToken(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	defaultResponseCache.purge()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("purged\n"))
+}
+
 func main() {
 	proxyRP, err := newReverseProxy(target)
 	if err != nil {
@@ -420,19 +1969,37 @@ func main() {
 		_, _ = w.Write([]byte("ok " + time.Now().Format(time.RFC3339)))
 	})
 
-	// 其余所有请求都转发到 translate.google.com
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		proxyRP.ServeHTTP(w, r)
-	})
+	// 响应缓存管理端点（不转发给 Google，需要 CACHE_ADMIN_TOKEN）
+	mux.HandleFunc("/cache/stats", cacheStatsHandler)
+	mux.HandleFunc("/cache/purge", cachePurgeHandler)
+
+	// SOCKS5 代理池状态
+	mux.HandleFunc("/proxies", proxiesHandler)
+
+	// Prometheus 指标
+	mux.Handle("/metrics", promhttp.Handler())
+
+	// 其余所有请求都转发到 translate.google.com；WebSocket 升级请求单独走 Hijack 透传，
+	// 不经过 httputil.ReverseProxy（它不支持全双工长连接）。
+	// 只有这个会真正发起 SOCKS5 拨号的路径才过熔断器，健康检查/指标/管理端点不应该消耗 Half-Open 探测名额
+	mux.Handle("/", breakerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebSocketUpgrade(r) {
+			proxyWebSocket(w, r)
+			return
+		}
+		proxyRP.ServeHTTP(newGRPCWebFlushWriter(w), r)
+	})))
 
 	addr := ":8080"
 	log.Printf("[INFO] reverse proxy for %s listening on %s", target, addr)
-	log.Printf("[INFO] %s from env: %q", socks5EnvKey, os.Getenv(socks5EnvKey))
+	log.Printf("[INFO] %s/%s from env: %q / %q", socks5URLsEnvKey, socks5EnvKey, os.Getenv(socks5URLsEnvKey), os.Getenv(socks5EnvKey))
 
 	server := &http.Server{
 		Addr: addr,
-		// 先限流，再记录访问日志：这样被限流的请求也会打访问日志
-		Handler:           loggingMiddleware(rateLimitMiddleware(mux)),
+		// 先限流，再把 clientIP 塞进 context 供 sticky_by_client_ip 策略使用，最后记录访问日志：
+		// 这样被限流拒绝的请求也会打访问日志。熔断器只包在 "/" 的上游调用路径上（见 main 里的注册），
+		// 避免 /healthz、/metrics 这类不发起上游调用的请求消耗 Half-Open 探测名额
+		Handler:           loggingMiddleware(rateLimitMiddleware(clientIPContextMiddleware(mux))),
 		ReadTimeout:       15 * time.Second,
 		ReadHeaderTimeout: 15 * time.Second,
 		WriteTimeout:      60 * time.Second,
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsAcceptKey 按 RFC 6455 算 Sec-WebSocket-Accept：Sec-WebSocket-Key 拼上固定 GUID 再 SHA1+Base64
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// writeWSTextFrame 写一个带掩码的文本帧（客户端->服务端方向按协议必须掩码）
+func writeWSTextFrame(conn net.Conn, payload []byte) error {
+	frame := []byte{0x81} // FIN=1, opcode=1 (text)
+	n := len(payload)
+	switch {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = append(frame, byte(n>>8), byte(n))
+	}
+	var mask [4]byte
+	_, _ = rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	masked := make([]byte, n)
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	frame = append(frame, masked...)
+	_, err := conn.Write(frame)
+	return err
+}
+
+// readWSFrame 读一个不带掩码的服务端帧（服务端->客户端方向按协议不掩码），返回 payload
+func readWSFrame(r *bufio.Reader) ([]byte, error) {
+	head := make([]byte, 2)
+	if _, err := readFull(r, head); err != nil {
+		return nil, err
+	}
+	length := int(head[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := readFull(r, ext); err != nil {
+			return nil, err
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := readFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+func readFull(r *bufio.Reader, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// selfSignedTLSConfig 生成一个只在测试里用的自签名证书，CN/SAN 设成 targetHost，
+// 这样 proxyWebSocket 里写死的 tls.Client(..., upstreamTLSConfig) 握手能过
+func selfSignedTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: targetHost},
+		DNSNames:     []string{targetHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// TestProxyWebSocketEchoFraming 用一个本地的 echo WebSocket 服务器顶替真实的 Google 上游，
+// 端到端验证 proxyWebSocket 的 Hijack + 转发链路不会破坏帧边界：客户端发出的带掩码文本帧
+// 原样到达 upstream，upstream 回的不带掩码的帧也原样回到客户端
+func TestProxyWebSocketEchoFraming(t *testing.T) {
+	upstreamLn, err := tls.Listen("tcp", "127.0.0.1:0", selfSignedTLSConfig(t))
+	if err != nil {
+		t.Fatalf("listen upstream: %v", err)
+	}
+	defer upstreamLn.Close()
+
+	const echoPayload = "hello websocket"
+
+	go func() {
+		conn, err := upstreamLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		accept := wsAcceptKey(req.Header.Get("Sec-WebSocket-Key"))
+		resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+
+		// 读客户端发来的带掩码文本帧，校验并原样回发（真正的 echo 语义）
+		head := make([]byte, 2)
+		if _, err := readFull(br, head); err != nil {
+			return
+		}
+		length := int(head[1] & 0x7f)
+		mask := make([]byte, 4)
+		if _, err := readFull(br, mask); err != nil {
+			return
+		}
+		masked := make([]byte, length)
+		if _, err := readFull(br, masked); err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		for i, b := range masked {
+			payload[i] = b ^ mask[i%4]
+		}
+
+		respFrame := []byte{0x81, byte(len(payload))}
+		respFrame = append(respFrame, payload...)
+		_, _ = conn.Write(respFrame)
+	}()
+
+	origDial := upstreamDialContext
+	origTLS := upstreamTLSConfig
+	defer func() {
+		upstreamDialContext = origDial
+		upstreamTLSConfig = origTLS
+	}()
+	upstreamDialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", upstreamLn.Addr().String())
+	}
+	upstreamTLSConfig = &tls.Config{ServerName: targetHost, InsecureSkipVerify: true}
+
+	defaultBreakerRegistry = newBreakerRegistry(defaultBreakerFailRatio, defaultBreakerMinSamples, defaultBreakerCooldown)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyWebSocket(w, r)
+	}))
+	defer proxy.Close()
+
+	clientConn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer clientConn.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(clientConn); err != nil {
+		t.Fatalf("write handshake request: %v", err)
+	}
+
+	clientReader := bufio.NewReader(clientConn)
+	resp, err := http.ReadResponse(clientReader, req)
+	if err != nil {
+		t.Fatalf("read handshake response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	if err := writeWSTextFrame(clientConn, []byte(echoPayload)); err != nil {
+		t.Fatalf("write ws frame: %v", err)
+	}
+
+	_ = clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := readWSFrame(clientReader)
+	if err != nil {
+		t.Fatalf("read ws frame: %v", err)
+	}
+	if string(got) != echoPayload {
+		t.Fatalf("framing corrupted: got %q, want %q", got, echoPayload)
+	}
+}